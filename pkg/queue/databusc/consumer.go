@@ -1,13 +1,16 @@
 package databusc
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
 	"os"
-	"strconv"
 	"time"
 	"github.com/mapgoo-lab/atreus/pkg/log"
+	"github.com/mapgoo-lab/atreus/pkg/queue/databusc/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"sync"
 )
 
@@ -26,6 +29,10 @@ type ConsumerEvent interface {
 
 	//提交offset
 	CommitMessage(msg *kafka.Message) error
+
+	//仅AutoCommitMode==3(store-only)时使用，处理成功后调用以存储offset，由enable.auto.commit异步提交，
+	//相比CommitMessage省去了每条消息一次的commit RPC开销
+	StoreMessage(msg *kafka.Message) error
 }
 
 type ConsumerParam struct {
@@ -33,11 +40,55 @@ type ConsumerParam struct {
 	GroupId string
 	Topic string
 	Dealhanle ConsumerDeal
-	//0:poll 1:channel
+	//0:poll 1:channel。两种模式都保证同一分区的消息按到达顺序串行处理：
+	//ConsumerMode==1下每个分区有独立的worker goroutine和offset tracker；
+	//ConsumerMode==0下分区按ThreadNum取模固定分发到queuelist中的一个worker，多个分区可能共享同一个worker，
+	//但同一个分区永远落在同一个worker上，重试/死信/按分区维度限流等能力目前只有ConsumerMode==1实现
 	ConsumerMode int
-	//0:commit 1:commitmsg 2:auto
+	//0:commit 1:commitmsg 2:auto 3:store-only，需要业务在处理成功后自行调用StoreMessage
 	AutoCommitMode int
+	//ConsumerMode==0下共享worker池的大小，分区按Partition%ThreadNum固定分发到其中一个worker
 	ThreadNum int
+
+	//range/roundrobin/cooperative-sticky，为空时使用librdkafka默认的range，
+	//cooperative-sticky下rebalance只会对新增/被撤销的分区做IncrementalAssign/IncrementalUnassign
+	RebalanceStrategy string
+
+	//ConsumerMode==1时，每个分区最多允许多少条消息同时在处理中，达到后该分区会被Pause，
+	//处理完成回落到阈值以下后自动Resume，<=0表示不限制
+	MaxInflightPerPartition int
+
+	//DealMessage返回非nil错误时的重试次数，<=0表示不重试直接投递死信。
+	//仅ConsumerMode==1生效：只有分区worker会在整个重试+死信流程结束后才调用StoreOffsets推进offset，
+	//ConsumerMode==0下offset在消息入队SendToChannel时就已经commit/store，重试和死信无法保证消息不丢，
+	//这里不处理，ConsumerMode==0下配置了这些字段只会在NewConsumer时记一条警告日志
+	MaxRetries int
+	//重试等待时间，按2^attempt指数增长并叠加随机抖动，<=0表示不等待立即重试，同样仅ConsumerMode==1生效
+	RetryBackoff time.Duration
+	//重试耗尽后投递的死信topic，为空时只记录日志，offset仍然照常推进，同样仅ConsumerMode==1生效
+	DeadLetterTopic string
+	//用于投递死信消息的producer，需要和DeadLetterTopic配套使用，同样仅ConsumerMode==1生效；
+	//真实场景传入NewProducer返回的*producerEvent，声明为接口是为了方便单测注入假的producer
+	DeadLetterProducer DeadLetterProducer
+
+	//plaintext/ssl/sasl_ssl/sasl_plaintext，为空表示使用librdkafka默认的plaintext
+	SecurityProtocol string
+	SASLMechanism string
+	SASLUsername string
+	SASLPassword string
+	SSLCALocation string
+	SSLCertLocation string
+	SSLKeyLocation string
+	SSLKeyPassword string
+
+	//配置后按Confluent wire format自动解码消息，解码结果通过ConsumerDealTyped接口下发
+	SchemaRegistry *SchemaRegistryParam
+
+	//为nil时使用otel.GetTracerProvider()，未注册SDK时退化为no-op
+	Tracer trace.TracerProvider
+
+	//为nil时使用prometheus.DefaultRegisterer
+	MetricsRegistry prometheus.Registerer
 }
 
 type consumerEvent struct {
@@ -45,10 +96,19 @@ type consumerEvent struct {
 	param *ConsumerParam
 	config kafka.ConfigMap
 	consumer *kafka.Consumer
+	//等于consumer，按partitionPauser这个更窄的接口持有，方便单测注入假的Pause/Resume而不需要真实连接broker
+	pauser partitionPauser
 	wg *sync.WaitGroup
 	exit chan int
 	queuelist []chan *kafka.Message
-	sis *Consistent
+	schemaDecoder *schemaDecoder
+
+	//ConsumerMode==1时，按分区维度管理worker，替代queuelist的按分区取模共享worker池方案
+	partMu sync.Mutex
+	partWg *sync.WaitGroup
+	partitionWorkers map[int32]*partitionWorker
+	commitIndex int32
+	tracer trace.Tracer
 }
 
 func NewConsumer(param *ConsumerParam, Id int) (ConsumerEvent, error) {
@@ -64,20 +124,46 @@ func NewConsumer(param *ConsumerParam, Id int) (ConsumerEvent, error) {
 	handle.config["client.id"] = fmt.Sprintf("rdkafka-%d-%d-%d", time.Now().Unix(), os.Getpid(), Id)
 	handle.config["auto.offset.reset"] = "latest"
 	handle.config["enable.auto.commit"] = true
-	handle.config["enable.auto.offset.store"] = true
+	//ConsumerMode==1由partitionWorker按分区内连续完成的offset主动调用StoreOffsets，
+	//AutoCommitMode==3由业务处理成功后调用StoreMessage，两种场景都不能再让librdkafka自动存储，
+	//否则未处理完的消息也会被提前计入提交
+	handle.config["enable.auto.offset.store"] = param.ConsumerMode != 1 && param.AutoCommitMode != 3
 	handle.config["socket.keepalive.enable"] = true
-//	handle.config["statistics.interval.ms"] = 5000
+	handle.config["statistics.interval.ms"] = 5000
 	handle.config["go.events.channel.enable"] = true
-//	handle.config["go.application.rebalance.enable"] = true
+	//ConsumerMode==1的分区worker生命周期完全依赖应用层收到AssignedPartitions/RevokedPartitions事件，
+	//不开启这个开关librdkafka会自己完成分配，assignPartitions永远不会被调用，worker也就永远不会创建
+	handle.config["go.application.rebalance.enable"] = param.ConsumerMode == 1
 	handle.config["enable.partition.eof"] = true
 
+	if param.RebalanceStrategy != "" {
+		handle.config["partition.assignment.strategy"] = param.RebalanceStrategy
+	}
+
+	applySecurityConfig(handle.config, param.SecurityProtocol, param.SASLMechanism, param.SASLUsername, param.SASLPassword,
+		param.SSLCALocation, param.SSLCertLocation, param.SSLKeyLocation, param.SSLKeyPassword)
+
+	if param.ConsumerMode != 1 && (param.MaxRetries > 0 || param.DeadLetterTopic != "") {
+		log.Error("MaxRetries/DeadLetterTopic are ignored when ConsumerMode!=1, offset is already committed before retry can run(topic:%s).", param.Topic)
+	}
+
 	consumer, err := kafka.NewConsumer(&handle.config)
 	if err != nil {
 		log.Error("NewConsumer error(topic:%s,err:%v).", param.Topic, err)
 		return nil, err
 	}
 
+	decoder, err := newSchemaDecoder(param.SchemaRegistry)
+	if err != nil {
+		log.Error("newSchemaDecoder error(topic:%s,err:%v).", param.Topic, err)
+		return nil, err
+	}
+	handle.schemaDecoder = decoder
+	handle.tracer = tracerOrDefault(param.Tracer)
+	metrics.RegisterDefault(param.MetricsRegistry)
+
 	handle.consumer = consumer
+	handle.pauser = consumer
 	handle.wg = new(sync.WaitGroup)
 	handle.wg.Add(1)
 	if handle.param.ConsumerMode == 1 {
@@ -88,63 +174,153 @@ func NewConsumer(param *ConsumerParam, Id int) (ConsumerEvent, error) {
 		handle.param.ThreadNum = 51
 	}
 
-	handle.sis = New()
-	for i := 0; i < handle.param.ThreadNum; i++ {
-		elt := fmt.Sprintf("%d", i)
-		handle.sis.Add(elt)
-	}
+	if handle.param.ConsumerMode == 1 {
+		handle.partWg = new(sync.WaitGroup)
+		handle.partitionWorkers = make(map[int32]*partitionWorker)
+	} else {
+		handle.queuelist = make([]chan *kafka.Message, handle.param.ThreadNum)
+		for i := 0; i < handle.param.ThreadNum; i++ {
+			handle.queuelist[i] = make(chan *kafka.Message, 2)
+			go func(index int) {
+				defer func() {
+					if r := recover(); r != nil {
+						log.Error("deal chan exception(r:%+v,index:%d)", r, index)
+					}
+				}()
 
-	handle.queuelist = make([]chan *kafka.Message, handle.param.ThreadNum)
-	for i := 0; i < handle.param.ThreadNum; i++ {
-		handle.queuelist[i] = make(chan *kafka.Message, 2)
-		go func(index int) {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Error("deal chan exception(r:%+v,index:%d)", r, index)
-				}
-			}()
-
-			for {
-				msg, ok := <-handle.queuelist[index]
-				if ok {
-					handle.param.Dealhanle.DealMessage(msg)
-				} else {
-					log.Error("deal chan is close(index:%d).", index)
-					break
+				for {
+					msg, ok := <-handle.queuelist[index]
+					if ok {
+						handle.dealMessage(msg)
+					} else {
+						log.Error("deal chan is close(index:%d).", index)
+						break
+					}
 				}
-			}
-		}(i)
+			}(i)
+		}
+
+		go handle.reportQueueDepth()
 	}
 
 	return handle, nil
 }
 
-func (handle *consumerEvent) SendToChannel(msg *kafka.Message, index int) {
-	var mod int32 = 0
-	iseffective := false
-	key := string(msg.Key)
-	if key != ""{
-		modstr, err := handle.sis.Get(key)
+//reportQueueDepth 周期性上报每个dealhanle worker队列(handle.queuelist[i])的当前长度，
+//仅ConsumerMode==0(poll)使用该队列池
+func (handle *consumerEvent) reportQueueDepth() {
+	clientId, _ := handle.config["client.id"].(string)
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if handle.isclose {
+			return
+		}
+		for i, q := range handle.queuelist {
+			metrics.ObserveQueueDepth(clientId, i, len(q))
+		}
+	}
+}
+
+//dealMessage 围绕一次消息处理开启子span，span结束时记录错误。重试+死信只在ConsumerMode==1下接入，
+//见invokeDealhanleWithRetry的注释；ConsumerMode==0下offset在SendToChannel把消息入队时就已经commit/store，
+//重试耗尽后再投递死信也换不回已经提交的offset，所以这里直接调用invokeDealhanle，不做重试
+func (handle *consumerEvent) dealMessage(msg *kafka.Message) {
+	ctx, span := handle.startConsumerSpan(msg)
+	defer span.End()
+
+	var err error
+	if handle.param.ConsumerMode == 1 {
+		err = handle.invokeDealhanleWithRetry(ctx, msg)
+	} else {
+		err = handle.invokeDealhanle(ctx, msg)
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+//invokeDealhanleWithRetry 仅ConsumerMode==1下由dealMessage调用：失败时按MaxRetries原地重试(指数退避+抖动)，
+//重试耗尽后投递DeadLetterTopic，只有重试和死信投递都处理完之后才会返回，completePartitionMessage随后才会
+//调用StoreOffsets推进offset，从而保证offset只在重试+死信流程结束后才推进
+func (handle *consumerEvent) invokeDealhanleWithRetry(ctx context.Context, msg *kafka.Message) error {
+	maxRetries := handle.param.MaxRetries
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		err = handle.invokeDealhanle(ctx, msg)
 		if err == nil {
-			convstr, converr := strconv.Atoi(modstr)
-			if converr == nil {
-				iseffective = true
-				mod = int32(convstr)
+			return nil
+		}
+
+		if attempt == maxRetries {
+			break
+		}
+
+		log.Error("DealMessage retry(topic:%s,partition:%d,offset:%v,attempt:%d,err:%v).",
+			handle.param.Topic, msg.TopicPartition.Partition, msg.TopicPartition.Offset, attempt+1, err)
+
+		if backoff := retryBackoffWithJitter(handle.param.RetryBackoff, attempt); backoff > 0 {
+			time.Sleep(backoff)
+		}
+	}
+
+	handle.sendToDeadLetter(ctx, msg, err)
+	return err
+}
+
+//invokeDealhanle 按优先级选择Dealhanle实际实现的接口：
+//ConsumerDealTypedCtx(需SchemaRegistry解码成功，同时拿到ctx和value) > ConsumerDealCtx >
+//ConsumerDealTyped(需SchemaRegistry解码成功) > ConsumerDeal
+func (handle *consumerEvent) invokeDealhanle(ctx context.Context, msg *kafka.Message) error {
+	if handle.schemaDecoder != nil {
+		if typedCtx, ok := handle.param.Dealhanle.(ConsumerDealTypedCtx); ok {
+			value, err := handle.schemaDecoder.Decode(msg.Value)
+			if err == nil {
+				return typedCtx.DealMessageTypedCtx(ctx, msg, value)
 			}
+			log.Error("schema registry decode error(topic:%s,err:%v).", handle.param.Topic, err)
 		}
 	}
 
-	if iseffective == false {
-		mod = msg.TopicPartition.Partition % int32(handle.param.ThreadNum)
+	if typed, ok := handle.param.Dealhanle.(ConsumerDealCtx); ok {
+		return typed.DealMessageCtx(ctx, msg)
+	}
+
+	if handle.schemaDecoder != nil {
+		if typed, ok := handle.param.Dealhanle.(ConsumerDealTyped); ok {
+			value, err := handle.schemaDecoder.Decode(msg.Value)
+			if err == nil {
+				return typed.DealMessageTyped(msg, value)
+			}
+			log.Error("schema registry decode error(topic:%s,err:%v).", handle.param.Topic, err)
+		}
 	}
 
+	return handle.param.Dealhanle.DealMessage(msg)
+}
+
+//SendToChannel 仅用于ConsumerMode==0(poll)，按分区取模把消息固定分发到共享worker池中的同一个worker，
+//同一分区永远落在同一个queuelist[i]上、由同一个goroutine串行处理，从而保留Kafka的分区内顺序；
+//多个分区可能共享同一个worker，互不影响彼此的顺序。
+//commit/store发生在消息入队的这一刻，早于dealMessage真正处理完成，因此这条路径不支持MaxRetries/DeadLetterTopic
+func (handle *consumerEvent) SendToChannel(msg *kafka.Message) {
+	mod := msg.TopicPartition.Partition % int32(handle.param.ThreadNum)
+
 	handle.queuelist[mod] <- msg
 	if handle.param.AutoCommitMode == 0 {
-		if index > 1000 {
+		if handle.commitIndex > 1000 {
 			handle.consumer.Commit()
-			index = 0
+			handle.commitIndex = 0
 		}
-		index++
+		handle.commitIndex++
 	} else if handle.param.AutoCommitMode == 1 {
 		handle.consumer.CommitMessage(msg)
 	}
@@ -168,8 +344,6 @@ func (handle *consumerEvent) Start() error {
 			}
 		}
 
-		index := 0
-
 		for handle.isclose == false {
 			if handle.param.ConsumerMode == 0 {
 				ev := handle.consumer.Poll(100)
@@ -179,11 +353,11 @@ func (handle *consumerEvent) Start() error {
 
 				switch e := ev.(type) {
 				case *kafka.Message:
-					handle.SendToChannel(e, index)
-//				case *kafka.Stats:
-//					var stats map[string]interface{}
-//					json.Unmarshal([]byte(e.String()), &stats)
-//					log.Info("Stats: %v messages (%v bytes) messages consumed.", stats["rxmsgs"], stats["rxmsg_bytes"])
+					handle.SendToChannel(e)
+				case *kafka.Stats:
+					if err := metrics.Observe([]byte(e.String()), handle.param.GroupId); err != nil {
+						log.Error("parse kafka stats error(topic:%s,err:%v).", handle.param.Topic, err)
+					}
 				case kafka.Error:
 					log.Error("consumer error(code:%v,e:%v).", e.Code(), e)
 					if e.Code() == kafka.ErrAllBrokersDown {
@@ -201,12 +375,30 @@ func (handle *consumerEvent) Start() error {
 					switch e := ev.(type) {
 					case kafka.AssignedPartitions:
 						log.Error("AssignedPartitions(e:%v,%+v).", e, e.Partitions)
-						handle.consumer.Assign(e.Partitions)
+						if handle.isCooperative() {
+							handle.consumer.IncrementalAssign(e.Partitions)
+						} else {
+							handle.consumer.Assign(e.Partitions)
+						}
+						handle.assignPartitions(e.Partitions)
 					case kafka.RevokedPartitions:
 						log.Error("RevokedPartitions(e:%v).", e)
-						handle.consumer.Unassign()
+						//revokePartitions必须先于Unassign/IncrementalUnassign执行：它要等被撤销分区的
+						//worker把已经在处理中的消息处理完并StoreOffsets，再同步Commit一次，
+						//这些调用在分区被Unassign之后会因为partition已经不属于当前consumer而失败，
+						//未提交的已处理消息会在下一次分配到的consumer上被重新消费
+						handle.revokePartitions(e.Partitions)
+						if handle.isCooperative() {
+							handle.consumer.IncrementalUnassign(e.Partitions)
+						} else {
+							handle.consumer.Unassign()
+						}
 					case *kafka.Message:
-						handle.SendToChannel(e, index)
+						handle.dispatchToPartition(e)
+					case *kafka.Stats:
+						if err := metrics.Observe([]byte(e.String()), handle.param.GroupId); err != nil {
+							log.Error("parse kafka stats error(topic:%s,err:%v).", handle.param.Topic, err)
+						}
 					case kafka.PartitionEOF:
 						log.Error("PartitionEOF(e:%v).", e)
 					case kafka.Error:
@@ -236,8 +428,14 @@ func (handle *consumerEvent) Close() {
 	}
 	log.Info("wait consumerEvent is close(topic:%s).", handle.param.Topic)
 	handle.wg.Wait()
-	for i := 0; i < handle.param.ThreadNum; i++ {
-		close(handle.queuelist[i])
+
+	if handle.param.ConsumerMode == 1 {
+		handle.revokeAllPartitions()
+		handle.partWg.Wait()
+	} else {
+		for i := 0; i < handle.param.ThreadNum; i++ {
+			close(handle.queuelist[i])
+		}
 	}
 	handle.consumer.Close()
 	log.Info("consumerEvent is closed(topic:%s).", handle.param.Topic)
@@ -247,3 +445,16 @@ func (handle *consumerEvent) CommitMessage(msg *kafka.Message) error {
 	_, err := handle.consumer.CommitMessage(msg)
 	return err
 }
+
+//isCooperative RebalanceStrategy是否配置为cooperative-sticky增量式分区分配
+func (handle *consumerEvent) isCooperative() bool {
+	return handle.param.RebalanceStrategy == "cooperative-sticky"
+}
+
+//StoreMessage AutoCommitMode==3(store-only)时，业务在DealMessage处理成功后调用，
+//只把offset存入本地store，由enable.auto.commit的后台定时提交，避免每条消息一次commit RPC；
+//委托给库自带的StoreMessage，由它负责把存储的offset加1(提交的offset语义是"下一条待拉取的消息")
+func (handle *consumerEvent) StoreMessage(msg *kafka.Message) error {
+	_, err := handle.consumer.StoreMessage(msg)
+	return err
+}
@@ -0,0 +1,41 @@
+package databusc
+
+import (
+	"testing"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+//TestSendToChannelPinsPartitionToSameWorker 同一分区不同key的消息必须落在同一个worker上并保持入队顺序，
+//否则同一分区的消息可能被不同goroutine并发处理，破坏Kafka的分区内顺序保证
+func TestSendToChannelPinsPartitionToSameWorker(t *testing.T) {
+	handle := &consumerEvent{param: &ConsumerParam{Topic: "t", ThreadNum: 4}}
+	handle.queuelist = make([]chan *kafka.Message, handle.param.ThreadNum)
+	for i := range handle.queuelist {
+		handle.queuelist[i] = make(chan *kafka.Message, 10)
+	}
+
+	first := &kafka.Message{TopicPartition: kafka.TopicPartition{Partition: 2}, Key: []byte("a")}
+	second := &kafka.Message{TopicPartition: kafka.TopicPartition{Partition: 2}, Key: []byte("b")}
+	handle.SendToChannel(first)
+	handle.SendToChannel(second)
+
+	want := int32(2) % int32(handle.param.ThreadNum)
+	if got := <-handle.queuelist[want]; got != first {
+		t.Fatalf("first message off queuelist[%d] = %v, want %v", want, got, first)
+	}
+	if got := <-handle.queuelist[want]; got != second {
+		t.Fatalf("second message off queuelist[%d] = %v, want %v (order within a partition must be preserved)", want, got, second)
+	}
+
+	for i, q := range handle.queuelist {
+		if int32(i) == want {
+			continue
+		}
+		select {
+		case msg := <-q:
+			t.Fatalf("partition 2 message %v was routed to unrelated worker %d", msg, i)
+		default:
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package databusc
+
+import (
+	"context"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"github.com/mapgoo-lab/atreus/pkg/log"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+//DeadLetterProducer ConsumerParam.DeadLetterProducer的接口形式，*producerEvent已经实现了这个方法集
+type DeadLetterProducer interface {
+	SendMessage(ctx context.Context, msg *kafka.Message) error
+}
+
+//retryBackoffWithJitter 按2^attempt指数增长并叠加[0,base)的随机抖动，base<=0时不等待
+func retryBackoffWithJitter(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+
+	backoff := base * time.Duration(int64(1)<<uint(attempt))
+	return backoff + time.Duration(rand.Int63n(int64(base)))
+}
+
+//sendToDeadLetter 把原始消息连同x-original-topic/partition/offset/error/retry-count头投递到DeadLetterTopic，
+//未配置DeadLetterTopic或DeadLetterProducer时只记录日志
+func (handle *consumerEvent) sendToDeadLetter(ctx context.Context, msg *kafka.Message, cause error) {
+	if cause == nil {
+		return
+	}
+
+	if handle.param.DeadLetterTopic == "" || handle.param.DeadLetterProducer == nil {
+		log.Error("DealMessage retries exhausted, no DeadLetterTopic configured(topic:%s,partition:%d,offset:%v,err:%v).",
+			handle.param.Topic, msg.TopicPartition.Partition, msg.TopicPartition.Offset, cause)
+		return
+	}
+
+	dlqTopic := handle.param.DeadLetterTopic
+	dlqMsg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &dlqTopic, Partition: kafka.PartitionAny},
+		Key: msg.Key,
+		Value: msg.Value,
+		Headers: append([]kafka.Header{}, msg.Headers...),
+	}
+
+	dlqMsg.Headers = append(dlqMsg.Headers,
+		kafka.Header{Key: "x-original-topic", Value: []byte(handle.param.Topic)},
+		kafka.Header{Key: "x-original-partition", Value: []byte(strconv.Itoa(int(msg.TopicPartition.Partition)))},
+		kafka.Header{Key: "x-original-offset", Value: []byte(strconv.FormatInt(int64(msg.TopicPartition.Offset), 10))},
+		kafka.Header{Key: "x-error", Value: []byte(cause.Error())},
+		kafka.Header{Key: "x-retry-count", Value: []byte(strconv.Itoa(handle.param.MaxRetries))},
+	)
+
+	if err := handle.param.DeadLetterProducer.SendMessage(ctx, dlqMsg); err != nil {
+		log.Error("publish to dead letter topic error(topic:%s,dlq:%s,err:%v).", handle.param.Topic, dlqTopic, err)
+	}
+}
+
+func headerValue(msg *kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+//ReplayFromDeadLetter 消费dlqTopic中积压的死信消息，按x-original-topic头重新发布回原始topic，
+//供运维人员在问题修复后手动触发补偿；maxMessages<=0表示持续消费直到ctx被取消。
+//security参数和NewConsumer/NewProducer一致，DLQ topic和原始topic通常在同一个需要鉴权的集群上，
+//留空表示沿用librdkafka默认的plaintext
+func ReplayFromDeadLetter(ctx context.Context, address, groupId, dlqTopic string, producer *producerEvent, maxMessages int,
+	securityProtocol, saslMechanism, saslUsername, saslPassword, sslCALocation, sslCertLocation, sslKeyLocation, sslKeyPassword string) (int, error) {
+	config := make(kafka.ConfigMap)
+	config["bootstrap.servers"] = address
+	config["group.id"] = groupId
+	config["broker.address.family"] = "v4"
+	config["session.timeout.ms"] = 6000
+	config["auto.offset.reset"] = "earliest"
+	config["enable.auto.commit"] = true
+	//不能让librdkafka在Poll()返回时就自动存储offset：下面的x-original-topic缺失/republish失败
+	//都会continue跳过该消息，必须等SendMessage成功后才StoreOffsets，否则一条republish失败的死信
+	//会被auto-commit提交掉，后续重跑ReplayFromDeadLetter再也无法重试它
+	config["enable.auto.offset.store"] = false
+
+	applySecurityConfig(config, securityProtocol, saslMechanism, saslUsername, saslPassword,
+		sslCALocation, sslCertLocation, sslKeyLocation, sslKeyPassword)
+
+	consumer, err := kafka.NewConsumer(&config)
+	if err != nil {
+		log.Error("ReplayFromDeadLetter NewConsumer error(dlq:%s,err:%v).", dlqTopic, err)
+		return 0, err
+	}
+	defer consumer.Close()
+	//enable.auto.commit只在后台定时tick，函数在tick之前通过ctx.Done()或maxMessages返回时，
+	//刚刚重新发布过的消息offset还没被提交，下一次调用会重新拉取并重复发布；退出前显式提交一次，
+	//做法和Start()关闭时的提交一致
+	defer consumer.Commit()
+
+	if err := consumer.SubscribeTopics([]string{dlqTopic}, nil); err != nil {
+		log.Error("ReplayFromDeadLetter SubscribeTopics error(dlq:%s,err:%v).", dlqTopic, err)
+		return 0, err
+	}
+
+	replayed := 0
+	for maxMessages <= 0 || replayed < maxMessages {
+		select {
+		case <-ctx.Done():
+			return replayed, ctx.Err()
+		default:
+		}
+
+		ev := consumer.Poll(1000)
+		if ev == nil {
+			continue
+		}
+
+		switch e := ev.(type) {
+		case *kafka.Message:
+			originalTopic := headerValue(e, "x-original-topic")
+			if originalTopic == "" {
+				log.Error("ReplayFromDeadLetter message missing x-original-topic, skipped(dlq:%s).", dlqTopic)
+				continue
+			}
+
+			replayMsg := &kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &originalTopic, Partition: kafka.PartitionAny},
+				Key: e.Key,
+				Value: e.Value,
+			}
+
+			if err := producer.SendMessage(ctx, replayMsg); err != nil {
+				log.Error("ReplayFromDeadLetter republish error(topic:%s,err:%v).", originalTopic, err)
+				continue
+			}
+
+			tp := e.TopicPartition
+			tp.Offset++
+			if _, err := consumer.StoreOffsets([]kafka.TopicPartition{tp}); err != nil {
+				log.Error("ReplayFromDeadLetter StoreOffsets error(dlq:%s,partition:%d,offset:%v,err:%v).",
+					dlqTopic, tp.Partition, tp.Offset, err)
+			}
+
+			replayed++
+		case kafka.Error:
+			log.Error("ReplayFromDeadLetter consumer error(dlq:%s,code:%v,e:%v).", dlqTopic, e.Code(), e)
+		}
+	}
+
+	return replayed, nil
+}
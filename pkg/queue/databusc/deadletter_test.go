@@ -0,0 +1,120 @@
+package databusc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+//TestRetryBackoffWithJitter base<=0不等待，base>0时落在[2^attempt*base, 2^attempt*base+base)区间内
+func TestRetryBackoffWithJitter(t *testing.T) {
+	if backoff := retryBackoffWithJitter(0, 0); backoff != 0 {
+		t.Fatalf("retryBackoffWithJitter(0,0) = %v, want 0", backoff)
+	}
+
+	base := 10 * time.Millisecond
+	for attempt := 0; attempt < 4; attempt++ {
+		backoff := retryBackoffWithJitter(base, attempt)
+		want := base * time.Duration(int64(1)<<uint(attempt))
+		if backoff < want || backoff >= want+base {
+			t.Fatalf("retryBackoffWithJitter(%v,%d) = %v, want in [%v,%v)", base, attempt, backoff, want, want+base)
+		}
+	}
+}
+
+//fakeDeadLetterProducer 记录SendMessage收到的消息，用于断言死信头是否被正确填充
+type fakeDeadLetterProducer struct {
+	sent []*kafka.Message
+	err  error
+}
+
+func (p *fakeDeadLetterProducer) SendMessage(ctx context.Context, msg *kafka.Message) error {
+	p.sent = append(p.sent, msg)
+	return p.err
+}
+
+func newTestMessage(partition int32, offset kafka.Offset) *kafka.Message {
+	topic := "t"
+	return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: offset}}
+}
+
+//TestInvokeDealhanleWithRetrySucceedsOnNthAttempt 第N次尝试成功时不应该再投递死信
+func TestInvokeDealhanleWithRetrySucceedsOnNthAttempt(t *testing.T) {
+	dlq := &fakeDeadLetterProducer{}
+	attempts := 0
+	handle := &consumerEvent{param: &ConsumerParam{
+		Topic: "t",
+		Dealhanle: dealMessageFunc(func(msg *kafka.Message) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("boom")
+			}
+			return nil
+		}),
+		MaxRetries:         5,
+		DeadLetterTopic:    "dlq",
+		DeadLetterProducer: dlq,
+	}}
+
+	if err := handle.invokeDealhanleWithRetry(context.Background(), newTestMessage(0, 1)); err != nil {
+		t.Fatalf("invokeDealhanleWithRetry() error = %v, want nil", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("attempts = %d, want 3", attempts)
+	}
+	if len(dlq.sent) != 0 {
+		t.Fatalf("len(dlq.sent) = %d, want 0, success should not reach the dead letter topic", len(dlq.sent))
+	}
+}
+
+//TestInvokeDealhanleWithRetryExhaustedSendsToDeadLetter 重试耗尽后应该把原始topic/partition/offset/error头投递到DeadLetterTopic
+func TestInvokeDealhanleWithRetryExhaustedSendsToDeadLetter(t *testing.T) {
+	dlq := &fakeDeadLetterProducer{}
+	attempts := 0
+	handle := &consumerEvent{param: &ConsumerParam{
+		Topic: "orders",
+		Dealhanle: dealMessageFunc(func(msg *kafka.Message) error {
+			attempts++
+			return errors.New("boom")
+		}),
+		MaxRetries:         2,
+		RetryBackoff:       time.Millisecond,
+		DeadLetterTopic:    "dlq",
+		DeadLetterProducer: dlq,
+	}}
+
+	err := handle.invokeDealhanleWithRetry(context.Background(), newTestMessage(3, 42))
+	if err == nil {
+		t.Fatal("invokeDealhanleWithRetry() error = nil, want the last DealMessage error")
+	}
+	if attempts != 3 {
+		t.Fatalf("attempts = %d, want 3 (1 initial + 2 retries)", attempts)
+	}
+	if len(dlq.sent) != 1 {
+		t.Fatalf("len(dlq.sent) = %d, want 1", len(dlq.sent))
+	}
+
+	sent := dlq.sent[0]
+	wantHeaders := map[string]string{
+		"x-original-topic":     "orders",
+		"x-original-partition": "3",
+		"x-original-offset":    "42",
+		"x-error":              "boom",
+		"x-retry-count":        "2",
+	}
+	for key, want := range wantHeaders {
+		if got := headerValue(sent, key); got != want {
+			t.Fatalf("dead letter header %q = %q, want %q", key, got, want)
+		}
+	}
+}
+
+//dealMessageFunc 把普通函数适配成ConsumerDeal接口，方便测试注入不同的失败/成功序列
+type dealMessageFunc func(msg *kafka.Message) error
+
+func (f dealMessageFunc) DealMessage(msg *kafka.Message) error {
+	return f(msg)
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"github.com/mapgoo-lab/atreus/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ConsumerLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "databusc",
+		Name: "consumer_lag",
+		Help: "consumer lag per topic/partition reported by librdkafka statistics",
+	}, []string{"group_id", "topic", "partition"})
+
+	BrokerRTTAvg = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "databusc",
+		Name: "broker_rtt_avg_us",
+		Help: "average broker round-trip time in microseconds reported by librdkafka statistics",
+	}, []string{"client_id", "broker"})
+
+	RequestRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "databusc",
+		Name: "broker_request_rate",
+		Help: "per-broker per-request-type counter reported by librdkafka statistics",
+	}, []string{"client_id", "broker", "request_type"})
+
+	RxMsgsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "databusc",
+		Name: "rxmsgs_total",
+		Help: "total messages received, from librdkafka rxmsgs counter",
+	}, []string{"client_id"})
+
+	RxMsgBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "databusc",
+		Name: "rxmsg_bytes_total",
+		Help: "total bytes received, from librdkafka rxmsg_bytes counter",
+	}, []string{"client_id"})
+
+	TxMsgsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "databusc",
+		Name: "txmsgs_total",
+		Help: "total messages sent, from librdkafka txmsgs counter",
+	}, []string{"client_id"})
+
+	TxMsgBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "databusc",
+		Name: "txmsg_bytes_total",
+		Help: "total bytes sent, from librdkafka txmsg_bytes counter",
+	}, []string{"client_id"})
+
+	QueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "databusc",
+		Name: "queue_depth",
+		Help: "depth of each internal dealhanle worker queue(handle.queuelist[i])",
+	}, []string{"client_id", "index"})
+)
+
+//RegisterDefault 把默认的collectors注册到reg，reg为nil时使用prometheus.DefaultRegisterer，
+//重复注册(多个consumer/producer共用同一个registry)时忽略AlreadyRegisteredError
+func RegisterDefault(reg prometheus.Registerer) {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	collectors := []prometheus.Collector{
+		ConsumerLag, BrokerRTTAvg, RequestRate,
+		RxMsgsTotal, RxMsgBytesTotal, TxMsgsTotal, TxMsgBytesTotal,
+		QueueDepth,
+	}
+
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				log.Error("metrics RegisterDefault error(err:%v).", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+type brokerStats struct {
+	State string `json:"state"`
+	Rtt struct {
+		Avg float64 `json:"avg"`
+	} `json:"rtt"`
+	Req map[string]float64 `json:"req"`
+}
+
+type partitionStats struct {
+	ConsumerLag int64 `json:"consumer_lag"`
+}
+
+type topicStats struct {
+	Partitions map[string]partitionStats `json:"partitions"`
+}
+
+//Stats 是librdkafka statistics.interval.ms产生的JSON payload中与指标相关的字段子集，
+//完整字段列表见 https://github.com/edenhill/librdkafka/blob/master/STATISTICS.md
+type Stats struct {
+	ClientId string `json:"client_id"`
+	Type string `json:"type"`
+	Rxmsgs float64 `json:"rxmsgs"`
+	RxmsgBytes float64 `json:"rxmsg_bytes"`
+	Txmsgs float64 `json:"txmsgs"`
+	TxmsgBytes float64 `json:"txmsg_bytes"`
+	Brokers map[string]brokerStats `json:"brokers"`
+	Topics map[string]topicStats `json:"topics"`
+}
+
+var (
+	mu sync.Mutex
+	lastRxMsgs = make(map[string]float64)
+	lastRxMsgBytes = make(map[string]float64)
+	lastTxMsgs = make(map[string]float64)
+	lastTxMsgBytes = make(map[string]float64)
+	allBrokersDown = make(map[string]bool)
+)
+
+//Observe 解析一次statistics.interval.ms产生的JSON payload并更新Prometheus指标，
+//groupId仅用于ConsumerLag打标签，producer场景传空字符串即可
+func Observe(raw []byte, groupId string) error {
+	var stats Stats
+	if err := json.Unmarshal(raw, &stats); err != nil {
+		return err
+	}
+
+	clientId := stats.ClientId
+
+	mu.Lock()
+	addDelta(RxMsgsTotal.WithLabelValues(clientId), lastRxMsgs, clientId, stats.Rxmsgs)
+	addDelta(RxMsgBytesTotal.WithLabelValues(clientId), lastRxMsgBytes, clientId, stats.RxmsgBytes)
+	addDelta(TxMsgsTotal.WithLabelValues(clientId), lastTxMsgs, clientId, stats.Txmsgs)
+	addDelta(TxMsgBytesTotal.WithLabelValues(clientId), lastTxMsgBytes, clientId, stats.TxmsgBytes)
+
+	down := len(stats.Brokers) > 0
+	for name, broker := range stats.Brokers {
+		BrokerRTTAvg.WithLabelValues(clientId, name).Set(broker.Rtt.Avg)
+		for reqType, count := range broker.Req {
+			RequestRate.WithLabelValues(clientId, name, reqType).Set(count)
+		}
+		if broker.State != "" && broker.State != "DOWN" {
+			down = false
+		}
+	}
+	allBrokersDown[clientId] = down
+	mu.Unlock()
+
+	for topic, t := range stats.Topics {
+		for partition, p := range t.Partitions {
+			ConsumerLag.WithLabelValues(groupId, topic, partition).Set(float64(p.ConsumerLag))
+		}
+	}
+
+	return nil
+}
+
+//addDelta counter只能递增，用当前值减去上次观测到的值得到这个统计周期内的增量
+func addDelta(counter interface{ Add(float64) }, last map[string]float64, clientId string, current float64) {
+	delta := current - last[clientId]
+	if delta > 0 {
+		counter.Add(delta)
+	}
+	last[clientId] = current
+}
+
+//ObserveQueueDepth 上报某个dealhanle worker队列(handle.queuelist[i])的当前长度
+func ObserveQueueDepth(clientId string, index int, depth int) {
+	QueueDepth.WithLabelValues(clientId, strconv.Itoa(index)).Set(float64(depth))
+}
+
+//Healthz 供healthz探针使用，任意一个client的最近一次statistics显示所有broker都处于DOWN状态时报错，
+//对应librdkafka层面的kafka.ErrAllBrokersDown
+func Healthz() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for clientId, down := range allBrokersDown {
+		if down {
+			return fmt.Errorf("databusc: all brokers down(client_id:%s)", clientId)
+		}
+	}
+	return nil
+}
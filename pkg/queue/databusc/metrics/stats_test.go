@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+)
+
+//fakeCounter 实现addDelta要求的Add(float64)子集，用于在不依赖真实Prometheus collector的情况下断言累计值
+type fakeCounter struct {
+	total float64
+}
+
+func (c *fakeCounter) Add(delta float64) {
+	c.total += delta
+}
+
+//TestAddDeltaAccumulatesOnlyPositiveIncrease librdkafka的rxmsgs/txmsgs是单调递增的累计值，
+//addDelta应该只把两次观测之间的增量Add进去；current<=last(counter被重置或值没变化)时不应该Add
+func TestAddDeltaAccumulatesOnlyPositiveIncrease(t *testing.T) {
+	last := make(map[string]float64)
+	counter := &fakeCounter{}
+
+	addDelta(counter, last, "c1", 10)
+	if counter.total != 10 {
+		t.Fatalf("after first observe, total = %v, want 10", counter.total)
+	}
+
+	addDelta(counter, last, "c1", 15)
+	if counter.total != 15 {
+		t.Fatalf("after delta of 5, total = %v, want 15", counter.total)
+	}
+
+	//counter被重置，current(5) < last(15)，不应该把负增量Add进去，但last要更新成新的基准
+	addDelta(counter, last, "c1", 5)
+	if counter.total != 15 {
+		t.Fatalf("total after a counter reset = %v, want unchanged 15", counter.total)
+	}
+
+	addDelta(counter, last, "c1", 20)
+	if counter.total != 30 {
+		t.Fatalf("total after reset+delta of 15 = %v, want 30", counter.total)
+	}
+}
+
+//TestHealthzAllBrokersDown Observe喂入一次所有broker都是DOWN状态的statistics后，Healthz应该报错；
+//之后再喂入一次有broker恢复的statistics，Healthz应该恢复正常
+func TestHealthzAllBrokersDown(t *testing.T) {
+	clientId := "test-healthz-client"
+
+	down := fmt.Sprintf(`{"client_id":%q,"brokers":{"b1":{"state":"DOWN"}}}`, clientId)
+	if err := Observe([]byte(down), ""); err != nil {
+		t.Fatalf("Observe(down) error = %v, want nil", err)
+	}
+	if err := Healthz(); err == nil {
+		t.Fatal("Healthz() = nil, want an error while all brokers are down")
+	}
+
+	up := fmt.Sprintf(`{"client_id":%q,"brokers":{"b1":{"state":"UP"}}}`, clientId)
+	if err := Observe([]byte(up), ""); err != nil {
+		t.Fatalf("Observe(up) error = %v, want nil", err)
+	}
+	if err := Healthz(); err != nil {
+		t.Fatalf("Healthz() error = %v, want nil once a broker recovers", err)
+	}
+}
+
+//TestObserveInvalidJSON Observe在payload不是合法JSON时应该把解析错误透传给调用方
+func TestObserveInvalidJSON(t *testing.T) {
+	if err := Observe([]byte("not json"), ""); err == nil {
+		t.Fatal("Observe(invalid json) error = nil, want an error")
+	}
+}
@@ -0,0 +1,322 @@
+package databusc
+
+import (
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"github.com/mapgoo-lab/atreus/pkg/log"
+	"sync"
+	"sync/atomic"
+)
+
+//partitionWorker 将同一个分区的消息串行分发给唯一的worker goroutine，保证分区内的处理顺序，
+//并配合offsetTracker实现"只推进连续处理完成的offset"的手动存储
+type partitionWorker struct {
+	tp kafka.TopicPartition
+	pending *unboundedMsgQueue
+	queue chan *kafka.Message
+	tracker *offsetTracker
+	inflight int32
+	//done 在worker goroutine处理完queue里最后一条消息(含其StoreOffsets)后关闭，
+	//revokePartitions等它关闭后才能安全Commit并放心地把分区交还给Unassign
+	done chan struct{}
+
+	mu sync.Mutex
+	paused bool
+}
+
+//unboundedMsgQueue 基于Mutex+Cond的无界队列，dispatchToPartition运行在共享的事件循环goroutine上，
+//push必须永不阻塞；真正可能阻塞的queue<-msg发送交给feeder goroutine在pending和bounded queue之间搬运，
+//从而把某个分区的背压和event loop解耦，避免一个分区写满拖垮其它所有分区
+type unboundedMsgQueue struct {
+	mu sync.Mutex
+	cond *sync.Cond
+	msgs []*kafka.Message
+	closed bool
+}
+
+func newUnboundedMsgQueue() *unboundedMsgQueue {
+	q := &unboundedMsgQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+//push 追加一条消息并唤醒feeder，从不阻塞
+func (q *unboundedMsgQueue) push(msg *kafka.Message) {
+	q.mu.Lock()
+	q.msgs = append(q.msgs, msg)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+//pop 取出一条消息，队列为空且未关闭时阻塞等待；队列已关闭且取空时返回ok=false
+func (q *unboundedMsgQueue) pop() (*kafka.Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.msgs) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if len(q.msgs) == 0 {
+		return nil, false
+	}
+
+	msg := q.msgs[0]
+	q.msgs = q.msgs[1:]
+	return msg, true
+}
+
+//close 标记队列关闭并唤醒所有等待的feeder，pending中已有的消息仍然会被pop完
+func (q *unboundedMsgQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+//maxPendingOffsets completed中允许堆积的未连续offset数量上限。Kafka的offset是单调但不连续的
+//(日志压缩、事务/控制消息都会留下空洞)，如果nextOffset对应的offset永远不会被投递，completed会无限增长，
+//nextOffset也会永久卡住。超过这个阈值后，skipGap会假定nextOffset到下一个已完成offset之间是这样的空洞，
+//强制跳过它
+const maxPendingOffsets = 10000
+
+//offsetTracker 记录某个分区内已经完成处理的offset，只有当最早未完成的offset也处理完成时，
+//才把可以安全StoreOffsets的offset向前推进，避免乱序完成导致的offset空洞被提前提交
+type offsetTracker struct {
+	mu sync.Mutex
+	started bool
+	nextOffset kafka.Offset
+	completed map[kafka.Offset]bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{completed: make(map[kafka.Offset]bool)}
+}
+
+//complete 标记offset处理完成，返回可以安全StoreOffsets的offset，没有可推进的offset时返回-1
+func (t *offsetTracker) complete(offset kafka.Offset) kafka.Offset {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.started {
+		t.started = true
+		t.nextOffset = offset
+	}
+
+	t.completed[offset] = true
+
+	if len(t.completed) > maxPendingOffsets {
+		t.skipGap()
+	}
+
+	return t.drain()
+}
+
+//drain 从nextOffset开始清除所有连续完成的offset，返回可以安全StoreOffsets的offset，没有可推进的offset时返回-1
+func (t *offsetTracker) drain() kafka.Offset {
+	advance := kafka.Offset(-1)
+	for t.completed[t.nextOffset] {
+		delete(t.completed, t.nextOffset)
+		t.nextOffset++
+		advance = t.nextOffset
+	}
+	return advance
+}
+
+//skipGap completed堆积超过maxPendingOffsets时调用：找到其中最小的offset，把nextOffset直接跳到那里，
+//放弃中间这段空洞。这意味着该空洞永远不会被当作"已处理"提交，在高度压缩/大量使用事务的topic上，
+//这条手动存储offset的路径本来就不提供不丢不重复的保证，这里只是避免completed和nextOffset永久卡死
+func (t *offsetTracker) skipGap() {
+	next := kafka.Offset(-1)
+	for offset := range t.completed {
+		if next == -1 || offset < next {
+			next = offset
+		}
+	}
+	if next == -1 || next <= t.nextOffset {
+		return
+	}
+
+	log.Error("offsetTracker pending offsets exceeded limit, skipping gap(stuck-at:%v,skip-to:%v,pending:%d).",
+		t.nextOffset, next, len(t.completed))
+
+	for offset := range t.completed {
+		if offset < next {
+			delete(t.completed, offset)
+		}
+	}
+	t.nextOffset = next
+}
+
+//partitionPauser dispatchToPartition/completePartitionMessage用到的Pause/Resume子集，
+//*kafka.Consumer已经实现了这个方法集，声明为接口是为了方便单测注入假的consumer
+type partitionPauser interface {
+	Pause(partitions []kafka.TopicPartition) error
+	Resume(partitions []kafka.TopicPartition) error
+}
+
+func (handle *consumerEvent) maxInflightPerPartition() int32 {
+	if handle.param.MaxInflightPerPartition > 0 {
+		return int32(handle.param.MaxInflightPerPartition)
+	}
+	return 0
+}
+
+//assignPartitions 为每个新分配到的TopicPartition创建独立的worker goroutine，已存在的跳过
+func (handle *consumerEvent) assignPartitions(partitions []kafka.TopicPartition) {
+	handle.partMu.Lock()
+	defer handle.partMu.Unlock()
+
+	for _, tp := range partitions {
+		if _, ok := handle.partitionWorkers[tp.Partition]; ok {
+			continue
+		}
+		handle.partitionWorkers[tp.Partition] = handle.startPartitionWorker(tp)
+	}
+}
+
+//revokePartitions 关闭被撤销分区对应的worker goroutine，并在返回前等待它们把已在处理中的消息
+//处理完、StoreOffsets完成，再同步Commit一次：调用方必须在这之后才去Unassign/IncrementalUnassign，
+//分区一旦被Unassign，同一批消息的StoreOffsets/Commit会因为分区已经不属于当前consumer而静默失败
+func (handle *consumerEvent) revokePartitions(partitions []kafka.TopicPartition) {
+	handle.partMu.Lock()
+	workers := make([]*partitionWorker, 0, len(partitions))
+	for _, tp := range partitions {
+		w, ok := handle.partitionWorkers[tp.Partition]
+		if !ok {
+			continue
+		}
+		delete(handle.partitionWorkers, tp.Partition)
+		workers = append(workers, w)
+	}
+	handle.partMu.Unlock()
+
+	for _, w := range workers {
+		w.pending.close()
+		<-w.done
+	}
+
+	//handle.consumer仅在newTestConsumerEvent构造的单测场景下为nil，生产环境NewConsumer总会设置它
+	if len(workers) > 0 && handle.consumer != nil {
+		handle.consumer.Commit()
+	}
+}
+
+//revokeAllPartitions Close()时用于清空所有分区的worker goroutine
+func (handle *consumerEvent) revokeAllPartitions() {
+	handle.partMu.Lock()
+	workers := handle.partitionWorkers
+	handle.partitionWorkers = make(map[int32]*partitionWorker)
+	handle.partMu.Unlock()
+
+	for _, w := range workers {
+		w.pending.close()
+	}
+}
+
+func (handle *consumerEvent) startPartitionWorker(tp kafka.TopicPartition) *partitionWorker {
+	queueSize := 64
+	if handle.param.MaxInflightPerPartition > 0 {
+		queueSize = handle.param.MaxInflightPerPartition
+	}
+
+	w := &partitionWorker{
+		tp: tp,
+		pending: newUnboundedMsgQueue(),
+		queue: make(chan *kafka.Message, queueSize),
+		tracker: newOffsetTracker(),
+		done: make(chan struct{}),
+	}
+
+	handle.partWg.Add(1)
+	go func() {
+		defer handle.partWg.Done()
+		defer close(w.queue)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("partition feeder exception(r:%+v,topic:%s,partition:%d)", r, handle.param.Topic, tp.Partition)
+			}
+		}()
+
+		//feeder 把pending搬运到bounded queue，queue满时的阻塞只影响这个分区自己，不会拖住event loop
+		for {
+			msg, ok := w.pending.pop()
+			if !ok {
+				return
+			}
+			w.queue <- msg
+		}
+	}()
+
+	handle.partWg.Add(1)
+	go func() {
+		defer handle.partWg.Done()
+		defer close(w.done)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("partition worker exception(r:%+v,topic:%s,partition:%d)", r, handle.param.Topic, tp.Partition)
+			}
+		}()
+
+		for msg := range w.queue {
+			handle.dealMessage(msg)
+			handle.completePartitionMessage(w, msg)
+		}
+	}()
+
+	return w
+}
+
+//dispatchToPartition 把消息交给对应分区的worker，达到MaxInflightPerPartition时Pause该分区暂停抓取
+func (handle *consumerEvent) dispatchToPartition(msg *kafka.Message) {
+	handle.partMu.Lock()
+	w, ok := handle.partitionWorkers[msg.TopicPartition.Partition]
+	handle.partMu.Unlock()
+	if !ok {
+		log.Error("message for unassigned partition, dropped(topic:%s,partition:%d).", handle.param.Topic, msg.TopicPartition.Partition)
+		return
+	}
+
+	inflight := atomic.AddInt32(&w.inflight, 1)
+	if limit := handle.maxInflightPerPartition(); limit > 0 && inflight >= limit {
+		w.mu.Lock()
+		if !w.paused {
+			w.paused = true
+			handle.pauser.Pause([]kafka.TopicPartition{w.tp})
+			log.Error("partition paused(topic:%s,partition:%d,inflight:%d).", handle.param.Topic, w.tp.Partition, inflight)
+		}
+		w.mu.Unlock()
+	}
+
+	w.pending.push(msg)
+}
+
+//completePartitionMessage 推进该分区已连续完成的offset并在越过MaxInflightPerPartition的分区上Resume抓取。
+//AutoCommitMode==1时在StoreOffsets成功后同步Commit一次，和SendToChannel里的CommitMessage保持同等的
+//"每次推进就提交"强度，不让ConsumerMode==1退化成只靠enable.auto.commit的后台tick
+func (handle *consumerEvent) completePartitionMessage(w *partitionWorker, msg *kafka.Message) {
+	//handle.consumer仅在newTestConsumerEvent构造的单测场景下为nil，生产环境NewConsumer总会设置它
+	if advance := w.tracker.complete(msg.TopicPartition.Offset); advance >= 0 && handle.consumer != nil {
+		tp := w.tp
+		tp.Offset = advance
+		if _, err := handle.consumer.StoreOffsets([]kafka.TopicPartition{tp}); err != nil {
+			log.Error("StoreOffsets error(topic:%s,partition:%d,offset:%v,err:%v).", handle.param.Topic, tp.Partition, advance, err)
+		} else if handle.param.AutoCommitMode == 1 {
+			if _, err := handle.consumer.Commit(); err != nil {
+				log.Error("Commit error(topic:%s,partition:%d,offset:%v,err:%v).", handle.param.Topic, tp.Partition, advance, err)
+			}
+		}
+	}
+
+	inflight := atomic.AddInt32(&w.inflight, -1)
+
+	limit := handle.maxInflightPerPartition()
+	if limit > 0 && inflight < limit {
+		w.mu.Lock()
+		if w.paused {
+			w.paused = false
+			handle.pauser.Resume([]kafka.TopicPartition{w.tp})
+			log.Error("partition resumed(topic:%s,partition:%d).", handle.param.Topic, w.tp.Partition)
+		}
+		w.mu.Unlock()
+	}
+}
@@ -0,0 +1,241 @@
+package databusc
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+//TestOffsetTrackerAdvancesOnlyContiguous 乱序完成的offset不应该提前把空洞推进，
+//只有最早未完成的offset也完成后，才能一次性推进到其后第一个仍未完成的offset
+func TestOffsetTrackerAdvancesOnlyContiguous(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	if advance := tracker.complete(12); advance != 13 {
+		t.Fatalf("complete(12) = %v, want 13", advance)
+	}
+
+	if advance := tracker.complete(14); advance != -1 {
+		t.Fatalf("complete(14) out of order = %v, want -1", advance)
+	}
+
+	if advance := tracker.complete(13); advance != 15 {
+		t.Fatalf("complete(13) closing the gap = %v, want 15", advance)
+	}
+}
+
+//TestOffsetTrackerSkipsGapPastLimit 如果nextOffset对应的offset永远不会到达(日志压缩/事务控制消息留下的空洞)，
+//completed不应该无限增长，超过maxPendingOffsets后应该跳过空洞继续推进
+func TestOffsetTrackerSkipsGapPastLimit(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	tracker.complete(0)
+	for offset := kafka.Offset(2); offset <= maxPendingOffsets+2; offset++ {
+		tracker.complete(offset)
+	}
+
+	if tracker.nextOffset <= 1 {
+		t.Fatalf("nextOffset = %v, want it to have skipped past the gap at offset 1", tracker.nextOffset)
+	}
+	if len(tracker.completed) != 0 {
+		t.Fatalf("len(completed) = %d, want 0 after draining past the skipped gap", len(tracker.completed))
+	}
+}
+
+//TestUnboundedMsgQueuePushPop push永不阻塞，pop按FIFO顺序取出
+func TestUnboundedMsgQueuePushPop(t *testing.T) {
+	q := newUnboundedMsgQueue()
+
+	topic := "t"
+	first := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: 1}}
+	second := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: 2}}
+
+	q.push(first)
+	q.push(second)
+
+	msg, ok := q.pop()
+	if !ok || msg != first {
+		t.Fatalf("pop() = %v,%v, want first,true", msg, ok)
+	}
+
+	msg, ok = q.pop()
+	if !ok || msg != second {
+		t.Fatalf("pop() = %v,%v, want second,true", msg, ok)
+	}
+}
+
+//TestUnboundedMsgQueuePopBlocksUntilPush pop在队列为空时阻塞等待，直到push唤醒
+func TestUnboundedMsgQueuePopBlocksUntilPush(t *testing.T) {
+	q := newUnboundedMsgQueue()
+
+	done := make(chan *kafka.Message, 1)
+	go func() {
+		msg, ok := q.pop()
+		if !ok {
+			done <- nil
+			return
+		}
+		done <- msg
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("pop() returned before push(), want it to block")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	topic := "t"
+	msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}
+	q.push(msg)
+
+	select {
+	case got := <-done:
+		if got != msg {
+			t.Fatalf("pop() = %v, want %v", got, msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pop() did not unblock after push()")
+	}
+}
+
+//TestUnboundedMsgQueueCloseDrainsThenStops close()之后仍能取出之前已经push的消息，
+//全部取完后pop()返回ok=false而不是永远阻塞
+func TestUnboundedMsgQueueCloseDrainsThenStops(t *testing.T) {
+	q := newUnboundedMsgQueue()
+
+	topic := "t"
+	msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}
+	q.push(msg)
+	q.close()
+
+	got, ok := q.pop()
+	if !ok || got != msg {
+		t.Fatalf("pop() after close() = %v,%v, want msg,true", got, ok)
+	}
+
+	if _, ok := q.pop(); ok {
+		t.Fatal("pop() on drained closed queue = true, want false")
+	}
+}
+
+//fakePartitionPauser 记录Pause/Resume的调用，用于在没有真实kafka.Consumer的情况下断言
+//MaxInflightPerPartition触发暂停/恢复抓取的时机
+type fakePartitionPauser struct {
+	mu      sync.Mutex
+	paused  []kafka.TopicPartition
+	resumed []kafka.TopicPartition
+}
+
+func (p *fakePartitionPauser) Pause(partitions []kafka.TopicPartition) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = append(p.paused, partitions...)
+	return nil
+}
+
+func (p *fakePartitionPauser) Resume(partitions []kafka.TopicPartition) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resumed = append(p.resumed, partitions...)
+	return nil
+}
+
+func (p *fakePartitionPauser) pauseCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.paused)
+}
+
+func (p *fakePartitionPauser) resumeCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.resumed)
+}
+
+//blockFirstDealer 第一次调用DealMessage时阻塞到release关闭才返回，之后的调用立即返回，
+//用于在保持分区worker串行处理的前提下人为制造一个持续积压的分区
+type blockFirstDealer struct {
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockFirstDealer) DealMessage(msg *kafka.Message) error {
+	if atomic.AddInt32(&d.calls, 1) == 1 {
+		close(d.started)
+		<-d.release
+	}
+	return nil
+}
+
+//waitUntil 轮询cond直到为true或超时，用于等待worker goroutine异步更新的状态收敛
+func waitUntil(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition did not become true before the timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+//TestMaxInflightPerPartitionPausesAndResumes inflight达到MaxInflightPerPartition时应该Pause该分区恰好一次，
+//即使后续消息继续把inflight推得更高；inflight回落到阈值以下后应该Resume
+func TestMaxInflightPerPartitionPausesAndResumes(t *testing.T) {
+	handle := newTestConsumerEvent()
+	handle.param.ConsumerMode = 1
+	handle.param.MaxInflightPerPartition = 2
+
+	dealer := &blockFirstDealer{started: make(chan struct{}), release: make(chan struct{})}
+	handle.param.Dealhanle = dealer
+
+	pauser := &fakePartitionPauser{}
+	handle.pauser = pauser
+
+	defer func() {
+		handle.revokeAllPartitions()
+		handle.partWg.Wait()
+	}()
+
+	handle.assignPartitions([]kafka.TopicPartition{tpFor(0)})
+	w := handle.partitionWorkers[0]
+
+	handle.dispatchToPartition(&kafka.Message{TopicPartition: tpFor(0)})
+	select {
+	case <-dealer.started:
+	case <-time.After(time.Second):
+		t.Fatal("DealMessage was never invoked for the first dispatched message")
+	}
+	if pauser.pauseCount() != 0 {
+		t.Fatalf("pauseCount = %d, want 0 before inflight reaches the limit", pauser.pauseCount())
+	}
+
+	//第一条消息还卡在DealMessage里没有完成，第二条消息让inflight达到MaxInflightPerPartition(2)，应该触发一次Pause
+	handle.dispatchToPartition(&kafka.Message{TopicPartition: tpFor(0)})
+	if pauser.pauseCount() != 1 {
+		t.Fatalf("pauseCount = %d, want 1 once inflight reaches the limit", pauser.pauseCount())
+	}
+	if !w.paused {
+		t.Fatal("w.paused = false, want true once inflight reaches the limit")
+	}
+
+	//第三条消息让inflight继续超过限制，但分区已经处于paused状态，不应该重复Pause
+	handle.dispatchToPartition(&kafka.Message{TopicPartition: tpFor(0)})
+	if pauser.pauseCount() != 1 {
+		t.Fatalf("pauseCount = %d, want still 1, Pause must not be called again while already paused", pauser.pauseCount())
+	}
+
+	close(dealer.release)
+
+	waitUntil(t, time.Second, func() bool { return atomic.LoadInt32(&w.inflight) == 0 })
+	if pauser.resumeCount() != 1 {
+		t.Fatalf("resumeCount = %d, want 1 once inflight drops back below the limit", pauser.resumeCount())
+	}
+	if w.paused {
+		t.Fatal("w.paused = true, want false after inflight dropped back below the limit")
+	}
+}
@@ -0,0 +1,121 @@
+package databusc
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"os"
+	"time"
+	"github.com/mapgoo-lab/atreus/pkg/log"
+	"github.com/mapgoo-lab/atreus/pkg/queue/databusc/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type ProducerParam struct {
+	Address string
+	Topic string
+
+	//plaintext/ssl/sasl_ssl/sasl_plaintext，为空表示使用librdkafka默认的plaintext
+	SecurityProtocol string
+	SASLMechanism string
+	SASLUsername string
+	SASLPassword string
+	SSLCALocation string
+	SSLCertLocation string
+	SSLKeyLocation string
+	SSLKeyPassword string
+
+	//为nil时使用otel.GetTracerProvider()，未注册SDK时退化为no-op
+	Tracer trace.TracerProvider
+
+	//为nil时使用prometheus.DefaultRegisterer
+	MetricsRegistry prometheus.Registerer
+}
+
+type producerEvent struct {
+	param *ProducerParam
+	config kafka.ConfigMap
+	producer *kafka.Producer
+	tracer trace.Tracer
+}
+
+func NewProducer(param *ProducerParam, Id int) (*producerEvent, error) {
+	handle := new(producerEvent)
+	handle.param = param
+
+	handle.config = make(kafka.ConfigMap)
+	handle.config["bootstrap.servers"] = param.Address
+	handle.config["client.id"] = fmt.Sprintf("rdkafka-producer-%d-%d-%d", time.Now().Unix(), os.Getpid(), Id)
+	handle.config["socket.keepalive.enable"] = true
+	handle.config["statistics.interval.ms"] = 5000
+
+	applySecurityConfig(handle.config, param.SecurityProtocol, param.SASLMechanism, param.SASLUsername, param.SASLPassword,
+		param.SSLCALocation, param.SSLCertLocation, param.SSLKeyLocation, param.SSLKeyPassword)
+
+	producer, err := kafka.NewProducer(&handle.config)
+	if err != nil {
+		log.Error("NewProducer error(topic:%s,err:%v).", param.Topic, err)
+		return nil, err
+	}
+
+	handle.producer = producer
+	handle.tracer = tracerOrDefault(param.Tracer)
+	metrics.RegisterDefault(param.MetricsRegistry)
+	go handle.handleEvents()
+
+	return handle, nil
+}
+
+func (handle *producerEvent) handleEvents() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("producerEvent handleEvents exception(r:%+v)", r)
+		}
+	}()
+
+	for e := range handle.producer.Events() {
+		switch ev := e.(type) {
+		case *kafka.Message:
+			if ev.TopicPartition.Error != nil {
+				log.Error("producer delivery error(topic:%s,err:%v).", handle.param.Topic, ev.TopicPartition.Error)
+			}
+		case *kafka.Stats:
+			if err := metrics.Observe([]byte(ev.String()), ""); err != nil {
+				log.Error("parse kafka stats error(topic:%s,err:%v).", handle.param.Topic, err)
+			}
+		case kafka.Error:
+			log.Error("producer error(code:%v,e:%v).", ev.Code(), ev)
+		}
+	}
+}
+
+//SendMessage 异步发送一条消息，投递结果通过handleEvents上报到日志；ctx中的活动span会按W3C格式注入消息头，
+//供下游消费端提取并延续链路
+func (handle *producerEvent) SendMessage(ctx context.Context, msg *kafka.Message) error {
+	ctx, span := handle.tracer.Start(ctx, handle.param.Topic+" send", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("messaging.system", "kafka"),
+		attribute.String("messaging.destination", messageTopic(msg, handle.param.Topic)),
+	)
+
+	injectSpan(ctx, msg)
+
+	if err := handle.producer.Produce(msg, nil); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (handle *producerEvent) Close() {
+	handle.producer.Flush(5000)
+	handle.producer.Close()
+	log.Info("producerEvent is closed(topic:%s).", handle.param.Topic)
+}
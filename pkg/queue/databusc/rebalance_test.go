@@ -0,0 +1,133 @@
+package databusc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+func newTestConsumerEvent() *consumerEvent {
+	return &consumerEvent{
+		param: &ConsumerParam{Topic: "t"},
+		partWg: new(sync.WaitGroup),
+		partitionWorkers: make(map[int32]*partitionWorker),
+		tracer: tracerOrDefault(nil),
+	}
+}
+
+//blockingDealer DealMessage阻塞到release被关闭才返回，用于验证revokePartitions
+//在worker还在处理消息时会等待，而不是立刻返回
+type blockingDealer struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDealer) DealMessage(msg *kafka.Message) error {
+	close(d.started)
+	<-d.release
+	return nil
+}
+
+func tpFor(partition int32) kafka.TopicPartition {
+	topic := "t"
+	return kafka.TopicPartition{Topic: &topic, Partition: partition}
+}
+
+//TestRebalanceOnlyChurnsAssignedDelta 模拟cooperative-sticky下rebalance只携带新增分区的场景：
+//再次assignPartitions已经在跑的分区时，已有的worker不应该被重建，只有真正新增的分区才会创建worker
+func TestRebalanceOnlyChurnsAssignedDelta(t *testing.T) {
+	handle := newTestConsumerEvent()
+	defer func() {
+		handle.revokeAllPartitions()
+		handle.partWg.Wait()
+	}()
+
+	handle.assignPartitions([]kafka.TopicPartition{tpFor(0), tpFor(1)})
+	if len(handle.partitionWorkers) != 2 {
+		t.Fatalf("len(partitionWorkers) = %d, want 2", len(handle.partitionWorkers))
+	}
+	w0 := handle.partitionWorkers[0]
+	w1 := handle.partitionWorkers[1]
+
+	//cooperative-sticky的下一轮AssignedPartitions只会带来增量分区，但也可能把已有分区重复带上，
+	//已有分区对应的worker必须原样保留，不能被替换成新的实例
+	handle.assignPartitions([]kafka.TopicPartition{tpFor(0), tpFor(1), tpFor(2)})
+	if len(handle.partitionWorkers) != 3 {
+		t.Fatalf("len(partitionWorkers) = %d, want 3", len(handle.partitionWorkers))
+	}
+	if handle.partitionWorkers[0] != w0 {
+		t.Fatal("partition 0 worker was recreated on a redundant assign, want the original instance kept")
+	}
+	if handle.partitionWorkers[1] != w1 {
+		t.Fatal("partition 1 worker was recreated on a redundant assign, want the original instance kept")
+	}
+}
+
+//TestRevokePartitionsOnlyRemovesGiven revokePartitions只应该移除被撤销的分区，
+//其余分区的worker必须不受影响地继续存在
+func TestRevokePartitionsOnlyRemovesGiven(t *testing.T) {
+	handle := newTestConsumerEvent()
+	defer func() {
+		handle.revokeAllPartitions()
+		handle.partWg.Wait()
+	}()
+
+	handle.assignPartitions([]kafka.TopicPartition{tpFor(0), tpFor(1), tpFor(2)})
+	w0 := handle.partitionWorkers[0]
+	w2 := handle.partitionWorkers[2]
+
+	handle.revokePartitions([]kafka.TopicPartition{tpFor(1)})
+
+	if len(handle.partitionWorkers) != 2 {
+		t.Fatalf("len(partitionWorkers) = %d, want 2", len(handle.partitionWorkers))
+	}
+	if _, ok := handle.partitionWorkers[1]; ok {
+		t.Fatal("partition 1 worker still present after revoke")
+	}
+	if handle.partitionWorkers[0] != w0 {
+		t.Fatal("partition 0 worker was churned by an unrelated partition's revoke")
+	}
+	if handle.partitionWorkers[2] != w2 {
+		t.Fatal("partition 2 worker was churned by an unrelated partition's revoke")
+	}
+}
+
+//TestRevokePartitionsWaitsForInflightMessage revokePartitions必须等到被撤销分区正在处理中的消息
+//真正处理完(从而StoreOffsets已经发生)才能返回，调用方才能安全地继续Unassign/IncrementalUnassign；
+//如果revokePartitions提前返回，Unassign之后再StoreOffsets的消息会因为分区已经不属于当前consumer而丢失
+func TestRevokePartitionsWaitsForInflightMessage(t *testing.T) {
+	handle := newTestConsumerEvent()
+	dealer := &blockingDealer{started: make(chan struct{}), release: make(chan struct{})}
+	handle.param.Dealhanle = dealer
+
+	handle.assignPartitions([]kafka.TopicPartition{tpFor(0)})
+	handle.dispatchToPartition(&kafka.Message{TopicPartition: tpFor(0)})
+
+	select {
+	case <-dealer.started:
+	case <-time.After(time.Second):
+		t.Fatal("DealMessage was never invoked for the dispatched message")
+	}
+
+	revoked := make(chan struct{})
+	go func() {
+		handle.revokePartitions([]kafka.TopicPartition{tpFor(0)})
+		close(revoked)
+	}()
+
+	select {
+	case <-revoked:
+		t.Fatal("revokePartitions returned while the in-flight message was still being processed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(dealer.release)
+
+	select {
+	case <-revoked:
+	case <-time.After(time.Second):
+		t.Fatal("revokePartitions did not return after the in-flight message finished processing")
+	}
+}
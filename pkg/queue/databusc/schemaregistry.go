@@ -0,0 +1,213 @@
+package databusc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"github.com/linkedin/goavro/v2"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//confluentMagicByte Confluent wire format的第一个字节，固定为0
+const confluentMagicByte = 0x00
+
+//SchemaRegistryParam 配置后，消费端会按照标准的Confluent wire format(magic byte+4字节schema id+payload)
+//自动向Schema Registry取回schema并解码消息，解码后的原生值通过ConsumerDealTyped/ConsumerDealTypedCtx接口下发。
+//Format=="protobuf"的descriptor-based解码(把registry返回的.proto源码编译成descriptor再动态解析)还没有实现，
+//配置为protobuf会在NewConsumer时直接返回错误，而不是返回一个看起来已解码、实际只是剥了头的字节数组
+type SchemaRegistryParam struct {
+	URL string
+	Username string
+	Password string
+	SSLCALocation string
+	SSLCertLocation string
+	SSLKeyLocation string
+	//avro/json，为空时按avro处理；protobuf暂不支持，见上面的类型注释
+	Format string
+}
+
+//ConsumerDealTyped 使用者可选实现的接口，配置了SchemaRegistry后优先于DealMessage调用该接口，
+//Dealhanle同时实现了ConsumerDealCtx时改为调用ConsumerDealCtx，
+//value为Schema Registry解码后的原生值，msg仍为原始的*kafka.Message
+type ConsumerDealTyped interface {
+	DealMessageTyped(msg *kafka.Message, value interface{}) error
+}
+
+type schemaDecoder struct {
+	param *SchemaRegistryParam
+	client *http.Client
+
+	mu sync.RWMutex
+	avroCodecs map[int]*goavro.Codec
+	rawSchemas map[int]string
+}
+
+func newSchemaDecoder(param *SchemaRegistryParam) (*schemaDecoder, error) {
+	if param == nil || param.URL == "" {
+		return nil, nil
+	}
+
+	client, err := newSchemaRegistryClient(param)
+	if err != nil {
+		return nil, err
+	}
+
+	if param.Format == "" {
+		param.Format = "avro"
+	}
+	if param.Format == "protobuf" {
+		return nil, fmt.Errorf("databusc: protobuf schema decoding is not implemented yet")
+	}
+
+	return &schemaDecoder{
+		param: param,
+		client: client,
+		avroCodecs: make(map[int]*goavro.Codec),
+		rawSchemas: make(map[int]string),
+	}, nil
+}
+
+func newSchemaRegistryClient(param *SchemaRegistryParam) (*http.Client, error) {
+	if param.SSLCALocation == "" && param.SSLCertLocation == "" && param.SSLKeyLocation == "" {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if param.SSLCALocation != "" {
+		caCert, err := ioutil.ReadFile(param.SSLCALocation)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(caCert)
+		tlsConfig.RootCAs = pool
+	}
+
+	if param.SSLCertLocation != "" && param.SSLKeyLocation != "" {
+		cert, err := tls.LoadX509KeyPair(param.SSLCertLocation, param.SSLKeyLocation)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+//Decode 解析标准的Confluent wire format并按Format返回解码后的原生值
+func (d *schemaDecoder) Decode(payload []byte) (interface{}, error) {
+	if len(payload) < 5 {
+		return nil, fmt.Errorf("databusc: schema registry payload too short(len:%d)", len(payload))
+	}
+	if payload[0] != confluentMagicByte {
+		return nil, fmt.Errorf("databusc: unexpected magic byte(byte:%d)", payload[0])
+	}
+
+	schemaId := int(binary.BigEndian.Uint32(payload[1:5]))
+	body := payload[5:]
+
+	switch d.param.Format {
+	case "json":
+		return d.decodeJSON(schemaId, body)
+	default:
+		return d.decodeAvro(schemaId, body)
+	}
+}
+
+func (d *schemaDecoder) decodeAvro(schemaId int, body []byte) (interface{}, error) {
+	codec, err := d.avroCodec(schemaId)
+	if err != nil {
+		return nil, err
+	}
+
+	native, _, err := codec.NativeFromBinary(body)
+	return native, err
+}
+
+func (d *schemaDecoder) avroCodec(schemaId int) (*goavro.Codec, error) {
+	d.mu.RLock()
+	codec, ok := d.avroCodecs[schemaId]
+	d.mu.RUnlock()
+	if ok {
+		return codec, nil
+	}
+
+	schema, err := d.fetchSchema(schemaId)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err = goavro.NewCodec(schema)
+	if err != nil {
+		return nil, fmt.Errorf("databusc: parse avro schema error(id:%d,err:%v)", schemaId, err)
+	}
+
+	d.mu.Lock()
+	d.avroCodecs[schemaId] = codec
+	d.mu.Unlock()
+
+	return codec, nil
+}
+
+//decodeJSON JSON Schema消息本身就是标准json，schema仅用于校验，这里只做payload解码
+func (d *schemaDecoder) decodeJSON(schemaId int, body []byte) (interface{}, error) {
+	var native interface{}
+	if err := json.Unmarshal(body, &native); err != nil {
+		return nil, fmt.Errorf("databusc: decode json-schema payload error(id:%d,err:%v)", schemaId, err)
+	}
+	return native, nil
+}
+
+func (d *schemaDecoder) fetchSchema(schemaId int) (string, error) {
+	d.mu.RLock()
+	schema, ok := d.rawSchemas[schemaId]
+	d.mu.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	url := fmt.Sprintf("%s/schemas/ids/%d", strings.TrimRight(d.param.URL, "/"), schemaId)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if d.param.Username != "" {
+		req.SetBasicAuth(d.param.Username, d.param.Password)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("databusc: fetch schema error(id:%d,status:%d)", schemaId, resp.StatusCode)
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return "", err
+	}
+
+	d.mu.Lock()
+	d.rawSchemas[schemaId] = body.Schema
+	d.mu.Unlock()
+
+	return body.Schema, nil
+}
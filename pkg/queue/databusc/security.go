@@ -0,0 +1,38 @@
+package databusc
+
+import (
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+//applySecurityConfig 将TLS/SASL相关参数写入librdkafka的ConfigMap，consumer和producer共用
+//securityProtocol为空时表示保持librdkafka默认的plaintext，不做任何改动
+func applySecurityConfig(config kafka.ConfigMap, securityProtocol, saslMechanism, saslUsername, saslPassword,
+	sslCALocation, sslCertLocation, sslKeyLocation, sslKeyPassword string) {
+	if securityProtocol == "" {
+		return
+	}
+
+	config["security.protocol"] = securityProtocol
+
+	if saslMechanism != "" {
+		config["sasl.mechanism"] = saslMechanism
+	}
+	if saslUsername != "" {
+		config["sasl.username"] = saslUsername
+	}
+	if saslPassword != "" {
+		config["sasl.password"] = saslPassword
+	}
+	if sslCALocation != "" {
+		config["ssl.ca.location"] = sslCALocation
+	}
+	if sslCertLocation != "" {
+		config["ssl.certificate.location"] = sslCertLocation
+	}
+	if sslKeyLocation != "" {
+		config["ssl.key.location"] = sslKeyLocation
+	}
+	if sslKeyPassword != "" {
+		config["ssl.key.password"] = sslKeyPassword
+	}
+}
@@ -0,0 +1,103 @@
+package databusc
+
+import (
+	"context"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/mapgoo-lab/atreus/pkg/queue/databusc"
+
+//defaultPropagator 固定使用W3C traceparent/tracestate格式，不依赖otel.GetTextMapPropagator()：
+//该全局在没有注册SDK时退化为no-op propagator，会导致消息头里实际上什么都没写入/提取
+var defaultPropagator = propagation.TraceContext{}
+
+//ConsumerDealCtx 使用者可选实现的接口，实现后无论是否配置Tracer都优先于ConsumerDealTyped/ConsumerDeal调用，
+//ctx携带了当前消息的trace span(Tracer为nil时来自otel.GetTracerProvider())，
+//下游继续发起DB/HTTP调用时应该把ctx一并传下去以延续链路。
+//同时还需要SchemaRegistry解码结果的话改为实现ConsumerDealTypedCtx，否则这里拿不到解码后的value
+type ConsumerDealCtx interface {
+	DealMessageCtx(ctx context.Context, msg *kafka.Message) error
+}
+
+//ConsumerDealTypedCtx 使用者可选实现的接口，配置了SchemaRegistry时优先于
+//ConsumerDealCtx/ConsumerDealTyped调用，一次性拿到trace ctx和解码后的value；
+//SchemaRegistry解码失败时，Dealhanle实现了ConsumerDealCtx则退化到它(有ctx没有value)，否则退化到DealMessage
+type ConsumerDealTypedCtx interface {
+	DealMessageTypedCtx(ctx context.Context, msg *kafka.Message, value interface{}) error
+}
+
+//kafkaHeaderCarrier 把kafka.Message.Headers适配成propagation.TextMapCarrier，
+//用于在生产端/消费端之间通过消息头传递W3C traceparent/tracestate
+type kafkaHeaderCarrier struct {
+	msg *kafka.Message
+}
+
+func (c kafkaHeaderCarrier) Get(key string) string {
+	for _, h := range c.msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c kafkaHeaderCarrier) Set(key, value string) {
+	for i, h := range c.msg.Headers {
+		if h.Key == key {
+			c.msg.Headers[i].Value = []byte(value)
+			return
+		}
+	}
+	c.msg.Headers = append(c.msg.Headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c kafkaHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.msg.Headers))
+	for _, h := range c.msg.Headers {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+//tracerOrDefault provider为nil时退回otel.GetTracerProvider()，未注册SDK时该provider本身就是no-op实现
+func tracerOrDefault(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+//injectSpan 把ctx中当前激活的span按W3C traceparent/tracestate写入消息头
+func injectSpan(ctx context.Context, msg *kafka.Message) {
+	defaultPropagator.Inject(ctx, kafkaHeaderCarrier{msg: msg})
+}
+
+//messageTopic 优先取msg自带的topic，ReplayFromDeadLetter这类转发场景下消息的实际topic
+//和producer/consumer构造时固定的param.Topic并不是一回事；msg.TopicPartition.Topic为nil时退回fallback
+func messageTopic(msg *kafka.Message, fallback string) string {
+	if msg.TopicPartition.Topic != nil {
+		return *msg.TopicPartition.Topic
+	}
+	return fallback
+}
+
+//startConsumerSpan 从消息头中提取上游span作为parent，开启消费侧的子span并记录topic/partition/offset/consumer-group
+func (handle *consumerEvent) startConsumerSpan(msg *kafka.Message) (context.Context, trace.Span) {
+	parent := defaultPropagator.Extract(context.Background(), kafkaHeaderCarrier{msg: msg})
+	topic := messageTopic(msg, handle.param.Topic)
+
+	ctx, span := handle.tracer.Start(parent, handle.param.Topic+" receive", trace.WithSpanKind(trace.SpanKindConsumer))
+	span.SetAttributes(
+		attribute.String("messaging.system", "kafka"),
+		attribute.String("messaging.destination", topic),
+		attribute.Int64("messaging.kafka.partition", int64(msg.TopicPartition.Partition)),
+		attribute.Int64("messaging.kafka.offset", int64(msg.TopicPartition.Offset)),
+		attribute.String("messaging.kafka.consumer_group", handle.param.GroupId),
+	)
+
+	return ctx, span
+}
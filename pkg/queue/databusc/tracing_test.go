@@ -0,0 +1,120 @@
+package databusc
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+//TestKafkaHeaderCarrierGetSetKeys Set在已有同名header时原地覆盖，否则追加；Get/Keys读到的是追加后的结果
+func TestKafkaHeaderCarrierGetSetKeys(t *testing.T) {
+	msg := &kafka.Message{Headers: []kafka.Header{{Key: "x-existing", Value: []byte("old")}}}
+	c := kafkaHeaderCarrier{msg: msg}
+
+	c.Set("x-existing", "new")
+	if got := c.Get("x-existing"); got != "new" {
+		t.Fatalf("Get(x-existing) = %q, want %q", got, "new")
+	}
+	if len(msg.Headers) != 1 {
+		t.Fatalf("len(Headers) = %d, want 1 (Set on an existing key must overwrite, not append)", len(msg.Headers))
+	}
+
+	c.Set("traceparent", "00-abc-def-01")
+	if got := c.Get("traceparent"); got != "00-abc-def-01" {
+		t.Fatalf("Get(traceparent) = %q, want %q", got, "00-abc-def-01")
+	}
+	if got := c.Get("missing"); got != "" {
+		t.Fatalf("Get(missing) = %q, want empty", got)
+	}
+
+	wantKeys := map[string]bool{"x-existing": true, "traceparent": true}
+	if len(c.Keys()) != len(wantKeys) {
+		t.Fatalf("len(Keys()) = %d, want %d", len(c.Keys()), len(wantKeys))
+	}
+	for _, k := range c.Keys() {
+		if !wantKeys[k] {
+			t.Fatalf("Keys() returned unexpected key %q", k)
+		}
+	}
+}
+
+//typedCtxDealer 同时实现ConsumerDealTypedCtx和ConsumerDealCtx，用于断言invokeDealhanle的优先级选择
+type typedCtxDealer struct {
+	typedCtxCalled bool
+	ctxCalled      bool
+	gotValue       interface{}
+}
+
+func (d *typedCtxDealer) DealMessageTypedCtx(ctx context.Context, msg *kafka.Message, value interface{}) error {
+	d.typedCtxCalled = true
+	d.gotValue = value
+	return nil
+}
+
+func (d *typedCtxDealer) DealMessageCtx(ctx context.Context, msg *kafka.Message) error {
+	d.ctxCalled = true
+	return nil
+}
+
+func (d *typedCtxDealer) DealMessage(msg *kafka.Message) error {
+	return nil
+}
+
+//jsonSchemaPayload 拼出一个合法的Confluent wire format payload：magic byte+4字节schema id+json body，
+//schemaDecoder.decodeJSON不依赖schema id去取schema，随便填一个即可
+func jsonSchemaPayload(t *testing.T, body string) []byte {
+	t.Helper()
+	payload := make([]byte, 5)
+	payload[0] = confluentMagicByte
+	binary.BigEndian.PutUint32(payload[1:], 7)
+	return append(payload, []byte(body)...)
+}
+
+//TestInvokeDealhanlePrefersTypedCtxOverCtx Dealhanle同时实现ConsumerDealTypedCtx和ConsumerDealCtx时，
+//SchemaRegistry解码成功的情况下应该优先调用能同时拿到ctx和value的ConsumerDealTypedCtx
+func TestInvokeDealhanlePrefersTypedCtxOverCtx(t *testing.T) {
+	dealer := &typedCtxDealer{}
+	handle := &consumerEvent{
+		param:         &ConsumerParam{Topic: "t", Dealhanle: dealer},
+		schemaDecoder: &schemaDecoder{param: &SchemaRegistryParam{Format: "json"}},
+	}
+
+	msg := &kafka.Message{Value: jsonSchemaPayload(t, `{"a":1}`)}
+	if err := handle.invokeDealhanle(context.Background(), msg); err != nil {
+		t.Fatalf("invokeDealhanle() error = %v, want nil", err)
+	}
+
+	if !dealer.typedCtxCalled {
+		t.Fatal("DealMessageTypedCtx was not called, want it preferred over DealMessageCtx")
+	}
+	if dealer.ctxCalled {
+		t.Fatal("DealMessageCtx was called, want DealMessageTypedCtx to have taken priority")
+	}
+	if got, ok := dealer.gotValue.(map[string]interface{}); !ok || got["a"] != 1.0 {
+		t.Fatalf("gotValue = %#v, want decoded {\"a\":1}", dealer.gotValue)
+	}
+}
+
+//TestInvokeDealhanleFallsBackToCtxOnDecodeError SchemaRegistry解码失败时即使Dealhanle也实现了
+//ConsumerDealTypedCtx，也应该退化到只传ctx的ConsumerDealCtx，而不是直接调用不带ctx的ConsumerDeal
+func TestInvokeDealhanleFallsBackToCtxOnDecodeError(t *testing.T) {
+	dealer := &typedCtxDealer{}
+	handle := &consumerEvent{
+		param:         &ConsumerParam{Topic: "t", Dealhanle: dealer},
+		schemaDecoder: &schemaDecoder{param: &SchemaRegistryParam{Format: "json"}},
+	}
+
+	msg := &kafka.Message{Value: []byte{0x01}}
+	if err := handle.invokeDealhanle(context.Background(), msg); err != nil {
+		t.Fatalf("invokeDealhanle() error = %v, want nil", err)
+	}
+
+	if dealer.typedCtxCalled {
+		t.Fatal("DealMessageTypedCtx was called despite the decode error")
+	}
+	if !dealer.ctxCalled {
+		t.Fatal("DealMessageCtx was not called, want the decode failure to fall back to it")
+	}
+}